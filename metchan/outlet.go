@@ -0,0 +1,156 @@
+package metchan
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ryandotsmith/l2met/bucket"
+	"math"
+	"regexp"
+	"sort"
+)
+
+// An Outlet ships a batch of flushed buckets to some monitoring
+// backend. Channel selects one in New() based on cfg.MetchanUrl's
+// scheme.
+type Outlet interface {
+	Post(buckets []*bucket.Bucket) error
+}
+
+// ErrRetryable marks a Post failure as transient (e.g. a Librato 5xx
+// or a network error that survived its own in-place retries). The
+// Channel requeues the batch behind this error instead of dropping
+// it; any other error is treated as permanent and simply logged.
+var ErrRetryable = errors.New("metchan: outlet post failed, retry later")
+
+// Convert l2met data into Librato's API format.
+// A libratoMetric is either a count/sum/min/max composite gauge (the
+// usual case) or, for percentiles, a single Value gauge. The
+// composite fields are pointers so a percentile gauge can omit them
+// entirely rather than marshaling as a bogus "count":0 alongside its
+// value, which Librato treats as a (malformed) aggregate measurement.
+type libratoMetric struct {
+	Name   string   `json:"name"`
+	Time   int64    `json:"measure_time"`
+	Source string   `json:"source"`
+	Count  *int     `json:"count,omitempty"`
+	Sum    *float64 `json:"sum,omitempty"`
+	Max    *float64 `json:"max,omitempty"`
+	Min    *float64 `json:"min,omitempty"`
+	Value  *float64 `json:"value,omitempty"`
+}
+
+func (l *libratoMetric) String() string {
+	// Value gauges (percentiles) have no count/sum/max/min to show;
+	// printing them through the composite layout below would render
+	// every percentile as all zeroes with the actual value nowhere
+	// in sight.
+	if l.Value != nil {
+		return fmt.Sprintf("source=%s sample#%s=%f", l.Source, l.Name, *l.Value)
+	}
+	layout := "source=%s "
+	layout += "sample#%s.count=%d "
+	layout += "sample#%s.sum=%f "
+	layout += "sample#%s.max=%f "
+	layout += "sample#%s.min=%f"
+	var count int
+	var sum, max, min float64
+	if l.Count != nil {
+		count = *l.Count
+	}
+	if l.Sum != nil {
+		sum = *l.Sum
+	}
+	if l.Max != nil {
+		max = *l.Max
+	}
+	if l.Min != nil {
+		min = *l.Min
+	}
+	return fmt.Sprintf(layout,
+		l.Source,
+		l.Name, count,
+		l.Name, sum,
+		l.Name, max,
+		l.Name, min)
+}
+
+type libratoGauge struct {
+	Gauges []*libratoMetric `json:"gauges"`
+}
+
+// bucketsToLibratoMetrics expands each bucket into its composite
+// count/sum/min/max gauge plus one gauge per configured percentile.
+// Shared by LibratoOutlet and StdoutOutlet, which both speak this
+// schema.
+func bucketsToLibratoMetrics(buckets []*bucket.Bucket, percentiles []float64) []*libratoMetric {
+	metrics := make([]*libratoMetric, 0, len(buckets)*(1+len(percentiles)))
+	for _, b := range buckets {
+		source := sanitize(b.Id.Source)
+		count, sum, max, min := b.Count(), b.Sum(), b.Max(), b.Min()
+		metrics = append(metrics, &libratoMetric{
+			Name:   sanitize(b.Id.Name),
+			Time:   b.Id.Time.Unix(),
+			Source: source,
+			Count:  &count,
+			Sum:    &sum,
+			Max:    &max,
+			Min:    &min,
+		})
+		for _, p := range percentiles {
+			value := percentile(b.Vals, p)
+			metrics = append(metrics, &libratoMetric{
+				Name:   sanitize(b.Id.Name + percentileSuffix(p)),
+				Time:   b.Id.Time.Unix(),
+				Source: source,
+				Value:  &value,
+			})
+		}
+	}
+	return metrics
+}
+
+// Librato restricts metric names and source values to this
+// character set.
+var disallowedMetricChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+var repeatedUnderscores = regexp.MustCompile(`_{2,}`)
+
+// Librato's documented limit for both names and sources.
+const maxSanitizedLen = 255
+
+// sanitize makes s safe to use as a libratoMetric Name or Source:
+// disallowed characters become underscores, runs of underscores
+// collapse to one, and the result is truncated to Librato's limit.
+// Without this, arbitrary tokens flowing through CountReq(user) or
+// app-supplied metric names cause Librato to reject the whole batch.
+func sanitize(s string) string {
+	s = disallowedMetricChars.ReplaceAllString(s, "_")
+	s = repeatedUnderscores.ReplaceAllString(s, "_")
+	if len(s) > maxSanitizedLen {
+		s = s[:maxSanitizedLen]
+	}
+	return s
+}
+
+// percentileSuffix turns 0.95 into ".p95".
+func percentileSuffix(p float64) string {
+	return fmt.Sprintf(".p%d", int(math.Round(p*100)))
+}
+
+// percentile computes the nearest-rank percentile p (0, 1] of vals
+// without mutating the caller's slice.
+func percentile(vals []float64, p float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	sorted := make([]float64, len(vals))
+	copy(sorted, vals)
+	sort.Float64s(sorted)
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
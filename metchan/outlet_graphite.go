@@ -0,0 +1,48 @@
+package metchan
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ryandotsmith/l2met/bucket"
+	"net"
+	"net/url"
+)
+
+// GraphiteOutlet ships buckets to a Graphite carbon endpoint using
+// the plaintext line protocol: "<metric> <value> <timestamp>\n".
+// Each bucket becomes one line per stat (count/sum/max/min) plus
+// one line per configured percentile.
+type GraphiteOutlet struct {
+	addr        string
+	percentiles []float64
+}
+
+func NewGraphiteOutlet(u *url.URL, percentiles []float64) *GraphiteOutlet {
+	return &GraphiteOutlet{addr: u.Host, percentiles: percentiles}
+}
+
+func (g *GraphiteOutlet) Post(buckets []*bucket.Bucket) error {
+	conn, err := net.Dial("tcp", g.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var buf bytes.Buffer
+	for _, b := range buckets {
+		writeGraphiteBucket(&buf, b, g.percentiles)
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+func writeGraphiteBucket(buf *bytes.Buffer, b *bucket.Bucket, percentiles []float64) {
+	name := b.Id.Name
+	ts := b.Id.Time.Unix()
+	fmt.Fprintf(buf, "%s.count %d %d\n", name, b.Count(), ts)
+	fmt.Fprintf(buf, "%s.sum %f %d\n", name, b.Sum(), ts)
+	fmt.Fprintf(buf, "%s.max %f %d\n", name, b.Max(), ts)
+	fmt.Fprintf(buf, "%s.min %f %d\n", name, b.Min(), ts)
+	for _, p := range percentiles {
+		fmt.Fprintf(buf, "%s%s %f %d\n", name, percentileSuffix(p), percentile(b.Vals, p), ts)
+	}
+}
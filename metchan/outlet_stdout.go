@@ -0,0 +1,25 @@
+package metchan
+
+import (
+	"fmt"
+	"github.com/ryandotsmith/l2met/bucket"
+)
+
+// StdoutOutlet prints each bucket using l2met's usual log line
+// format instead of shipping it anywhere. Selected with
+// stdout://, it's handy for local development or for piping
+// metchan's own output into another log-based pipeline.
+type StdoutOutlet struct {
+	percentiles []float64
+}
+
+func NewStdoutOutlet(percentiles []float64) *StdoutOutlet {
+	return &StdoutOutlet{percentiles: percentiles}
+}
+
+func (s *StdoutOutlet) Post(buckets []*bucket.Bucket) error {
+	for _, m := range bucketsToLibratoMetrics(buckets, s.percentiles) {
+		fmt.Printf("at=outlet-metric %s\n", m.String())
+	}
+	return nil
+}
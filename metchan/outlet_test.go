@@ -0,0 +1,31 @@
+package metchan
+
+import "testing"
+
+func TestSanitize(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"user@example.com", "user_example.com"},
+		{"café.latency", "caf_.latency"},
+		{"a___b", "a_b"},
+		{"already-valid.name_123", "already-valid.name_123"},
+	}
+	for _, c := range cases {
+		if got := sanitize(c.in); got != c.want {
+			t.Errorf("sanitize(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestSanitizeTruncatesToLibratoLimit(t *testing.T) {
+	long := ""
+	for i := 0; i < 300; i++ {
+		long += "a"
+	}
+	got := sanitize(long)
+	if len(got) != maxSanitizedLen {
+		t.Fatalf("len(sanitize(long)) = %d, want %d", len(got), maxSanitizedLen)
+	}
+}